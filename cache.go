@@ -0,0 +1,111 @@
+package golibs
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// 进程内的查询结果缓存
+type resultCache struct {
+	mu      sync.RWMutex
+	entries map[cacheSlot]cacheEntry
+}
+
+// 缓存条目的键, 同一个 key 下 GetOne/GetMany 以及不同模型的结果分开存放
+type cacheSlot struct {
+	key string
+	op  string
+	typ reflect.Type
+}
+
+type cacheEntry struct {
+	value    interface{}
+	expireAt time.Time
+}
+
+var queryCache = &resultCache{entries: make(map[cacheSlot]cacheEntry)}
+
+func (c *resultCache) get(key cacheSlot) (interface{}, bool) {
+	if key.key == "" {
+		return nil, false
+	}
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expireAt) {
+		c.delete(key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *resultCache) set(key cacheSlot, value interface{}, ttl time.Duration) {
+	if key.key == "" || ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	c.entries[key] = cacheEntry{value: value, expireAt: time.Now().Add(ttl)}
+	c.mu.Unlock()
+}
+
+func (c *resultCache) delete(key cacheSlot) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
+
+// 删除 key 下的所有条目
+func (c *resultCache) invalidate(key string) {
+	c.mu.Lock()
+	for slot := range c.entries {
+		if slot.key == key {
+			delete(c.entries, slot)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// 缓存本次 GetOne/GetMany 的结果, 在 ttl 内相同 key 的查询直接返回缓存, 不访问数据库
+// 缓存按 key 区分, 不同条件的查询请使用不同的 key (同一个 key 下 GetOne、GetMany
+// 和不同模型的结果互不影响); 过期前数据库的修改不可见,
+// 数据变化后可以调用 InvalidateCache 主动失效. 只适合变化很少的只读数据.
+// GetMany 命中缓存时返回的是同一批对象, 调用方不要修改它们.
+func (q *QueryBuilder) Cache(key string, ttl time.Duration) *QueryBuilder {
+	q.cacheKey = key
+	q.cacheTTL = ttl
+	return q
+}
+
+// 使缓存中 key 对应的查询结果失效
+func InvalidateCache(key string) {
+	queryCache.invalidate(key)
+}
+
+// 本次查询在缓存中的键, op 为 "one" 或 "many"
+func (q *QueryBuilder) cacheSlot(op string) cacheSlot {
+	return cacheSlot{key: q.cacheKey, op: op, typ: q.typ}
+}
+
+// GetOne 命中缓存时把缓存的记录拷贝到 Target
+func (q *QueryBuilder) loadCachedOne() bool {
+	cached, ok := queryCache.get(q.cacheSlot("one"))
+	if !ok {
+		return false
+	}
+	reflect.ValueOf(q.Target).Elem().Set(reflect.ValueOf(cached).Elem())
+	return true
+}
+
+// 缓存 Target 的一份拷贝, 避免调用方之后的修改影响缓存
+func (q *QueryBuilder) storeCachedOne() {
+	if q.cacheKey == "" {
+		return
+	}
+	obj := reflect.New(q.typ)
+	obj.Elem().Set(reflect.ValueOf(q.Target).Elem())
+	queryCache.set(q.cacheSlot("one"), obj.Interface(), q.cacheTTL)
+}
@@ -0,0 +1,63 @@
+package golibs
+
+import (
+	"testing"
+	"time"
+)
+
+type testCity struct {
+	Id   int64
+	Name string
+}
+
+func TestCacheSeparatesOperationsAndModels(t *testing.T) {
+	defer InvalidateCache("k")
+	many := GetQueryBuilder().Select(&testUser{}).Cache("k", time.Minute)
+	queryCache.set(many.cacheSlot("many"), []interface{}{&testUser{Id: 1}}, time.Minute)
+
+	// 同一个 key 下 GetMany 的结果不会被 GetOne 当作自己的缓存
+	one := GetQueryBuilder().Select(&testUser{}).Cache("k", time.Minute)
+	if one.loadCachedOne() {
+		t.Fatal("GetOne hit the GetMany entry")
+	}
+
+	one.Target.(*testUser).Name = "a"
+	one.storeCachedOne()
+	other := GetQueryBuilder().Select(&testCity{}).Cache("k", time.Minute)
+	if other.loadCachedOne() {
+		t.Fatal("testCity hit the testUser entry")
+	}
+
+	again := GetQueryBuilder().Select(&testUser{}).Cache("k", time.Minute)
+	if !again.loadCachedOne() || again.Target.(*testUser).Name != "a" {
+		t.Fatalf("GetOne entry not found, got %+v", again.Target)
+	}
+	if cached, ok := queryCache.get(many.cacheSlot("many")); !ok || len(cached.([]interface{})) != 1 {
+		t.Fatal("GetMany entry was overwritten")
+	}
+
+	InvalidateCache("k")
+	if again.loadCachedOne() {
+		t.Fatal("entry survived InvalidateCache")
+	}
+	if _, ok := queryCache.get(many.cacheSlot("many")); ok {
+		t.Fatal("GetMany entry survived InvalidateCache")
+	}
+}
+
+func TestCacheHitDoesNotHideBuilderError(t *testing.T) {
+	defer InvalidateCache("bad")
+	ok := GetQueryBuilder().Select(&testUser{}).Cache("bad", time.Minute)
+	queryCache.set(ok.cacheSlot("many"), []interface{}{&testUser{Id: 1}}, time.Minute)
+	ok.Target.(*testUser).Id = 1
+	ok.storeCachedOne()
+
+	bad := GetQueryBuilder().Select(&testUser{}).Cache("bad", time.Minute).As("u; DROP TABLE x")
+	if _, err := bad.GetMany(); err == nil {
+		t.Error("GetMany returned the cached rows instead of the builder error")
+	}
+	bad = GetQueryBuilder().Select(&testUser{}).Cache("bad", time.Minute).As("u; DROP TABLE x")
+	if _, err := bad.GetOne(); err == nil {
+		t.Error("GetOne returned the cached row instead of the builder error")
+	}
+}
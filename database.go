@@ -0,0 +1,130 @@
+package golibs
+
+import (
+	"context"
+	"database/sql"
+)
+
+// 独立的数据库连接, 用于同时访问多个数据库(例如主库和分析库)
+// 包级别的 InitDB/Insert/GetQueryBuilder 等函数使用全局的 DB, 相当于默认的一个 Database.
+// 连接池、超时设置(ConnAcquireTimeout/DefaultTimeout)和日志都只作用于本连接及其上开启的事务.
+type Database struct {
+	db       *sql.DB
+	logger   Log
+	timeouts poolTimeouts
+}
+
+// 按配置打开一个新的数据库连接, 不影响全局的 DB
+// 配置错误或连接不上数据库时返回错误, 此时不会保留打开的连接池
+func Open(c *DbConfig) (*Database, error) {
+	d := &Database{logger: new(Logger)}
+	db, err := openDB(c, d.logger)
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return nil, err
+	}
+	d.db = db
+	d.timeouts = poolTimeouts{acquire: c.ConnAcquireTimeout, op: c.DefaultTimeout}
+	databases.Store(db, d)
+	return d, nil
+}
+
+// 替换本连接使用的日志, 本连接上的所有操作(包括事务和查询构造器)都使用该日志, 传入 nil 时恢复默认的 Logger
+func (d *Database) SetLogger(l Log) {
+	if l == nil {
+		l = new(Logger)
+	}
+	d.logger = l
+}
+
+// 检查本连接是否可用, 规则同 Ping
+func (d *Database) Ping() error {
+	if d == nil {
+		return ErrNotInitialized
+	}
+	err := ping(d.db)
+	if err != nil {
+		d.logger.Error(err)
+	}
+	return err
+}
+
+// 关闭本连接的连接池, 重复关闭时返回 nil
+func (d *Database) Close() error {
+	if d == nil || d.db == nil {
+		return nil
+	}
+	databases.Delete(d.db)
+	stmts.clear(d.db)
+	err := d.db.Close()
+	d.db = nil
+	d.logger.INFO("DB closed.")
+	return err
+}
+
+// 底层的连接池, 用于执行本包没有覆盖的操作
+func (d *Database) SqlDB() *sql.DB {
+	return d.db
+}
+
+// 插入一条记录, 返回记录的id
+func (d *Database) Insert(st interface{}) (int64, error) {
+	return insert(context.Background(), d.db, st)
+}
+
+// 根据id更新一条记录, 返回影响的条数
+func (d *Database) Update(st interface{}) (int64, error) {
+	return update(context.Background(), d.db, st)
+}
+
+// 根据id只更新列出的列, 规则同 UpdateFields
+func (d *Database) UpdateFields(st interface{}, fields ...string) (int64, error) {
+	return update(context.Background(), d.db, st, fields...)
+}
+
+// 根据id删除一条记录, 返回删除的条数
+func (d *Database) Delete(st interface{}) (int64, error) {
+	return del(context.Background(), d.db, st)
+}
+
+// 保存一条记录, 规则同 Save
+func (d *Database) Save(st interface{}) (int64, error) {
+	return save(context.Background(), d.db, st)
+}
+
+// 一条语句插入多条记录, 规则同 InsertBatch
+func (d *Database) InsertBatch(sts interface{}) (int64, error) {
+	return insertBatch(d.db, sts, false)
+}
+
+// 插入或更新一条记录, 规则同 Upsert
+func (d *Database) Upsert(st interface{}) (int64, error) {
+	return upsert(d.db, st, "")
+}
+
+// 在本连接上执行的查询构造器
+func (d *Database) GetQueryBuilder() *QueryBuilder {
+	q := GetQueryBuilder()
+	q.runner = d.db
+	return q
+}
+
+// 在本连接上开启一个事务
+func (d *Database) Begin() (*Tx, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx: tx, db: d}, nil
+}
+
+// 在本连接上的一个事务内执行 fn, 规则同 Transaction
+func (d *Database) Transaction(fn func(tx *Tx) error) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	return tx.run(fn)
+}
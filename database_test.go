@@ -0,0 +1,87 @@
+package golibs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 在测试连接池上构造一个 Database, 与 Open 打开的相同但不需要真正的数据库
+func newFakeDatabase(t *testing.T, l Log, timeouts poolTimeouts) (*Database, *fakeDB) {
+	db, f := newFakeDB(t)
+	d := &Database{db: db, logger: l, timeouts: timeouts}
+	databases.Store(db, d)
+	t.Cleanup(func() { d.Close() })
+	return d, f
+}
+
+func TestDatabaseUsesItsOwnLogger(t *testing.T) {
+	var own, global bytes.Buffer
+	oldLogger := logger
+	SetLogger(Logger{Out: &global, Level: LevelDebug})
+	defer SetLogger(oldLogger)
+
+	d, _ := newFakeDatabase(t, Logger{Out: &own, Level: LevelDebug}, poolTimeouts{})
+	if _, err := d.Insert(&testUser{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Update(&testUser{Id: 1, Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(own.String(), "INSERT INTO") || !strings.Contains(own.String(), "UPDATE") {
+		t.Errorf("Database logger got %q", own.String())
+	}
+	if global.Len() != 0 {
+		t.Errorf("package logger got %q", global.String())
+	}
+}
+
+func TestDatabaseTxUsesItsOwnTimeouts(t *testing.T) {
+	timeouts := poolTimeouts{acquire: time.Second, op: 2 * time.Second}
+	d, _ := newFakeDatabase(t, new(Logger), timeouts)
+	tx, err := d.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if got := timeoutsFor(tx.runner()); got != timeouts {
+		t.Errorf("timeoutsFor(tx) = %+v, want %+v", got, timeouts)
+	}
+	if got := timeoutsFor(tx.GetQueryBuilder().db()); got != timeouts {
+		t.Errorf("timeoutsFor(tx query) = %+v, want %+v", got, timeouts)
+	}
+	if got := timeoutsFor(d.GetQueryBuilder().db()); got != timeouts {
+		t.Errorf("timeoutsFor(query) = %+v, want %+v", got, timeouts)
+	}
+}
+
+func TestGlobalHelpersBeforeInitDB(t *testing.T) {
+	old := DB
+	DB = nil
+	defer func() { DB = old }()
+	for name, call := range map[string]func() error{
+		"ServerInfo":     func() error { _, err := ServerInfo(context.Background()); return err },
+		"Begin":          func() error { _, err := Begin(); return err },
+		"HasTable":       func() error { _, err := HasTable("testUser"); return err },
+		"HasColumn":      func() error { _, err := HasColumn("testUser", "id"); return err },
+		"ValidateSchema": func() error { return ValidateSchema(&testUser{}) },
+		"CreateTable":    func() error { return CreateTable(&testUser{}) },
+		"QueryMulti":     func() error { return QueryMulti("SELECT 1", &[]testUser{}) },
+		"InsertE":        func() error { _, err := InsertE(&testUser{}); return err },
+		"GetMany":        func() error { _, err := GetQueryBuilder().Select(&testUser{}).GetMany(); return err },
+	} {
+		if err := call(); !errors.Is(err, ErrNotInitialized) {
+			t.Errorf("%v error = %v, want ErrNotInitialized", name, err)
+		}
+	}
+}
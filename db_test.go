@@ -0,0 +1,551 @@
+package golibs
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	Id   int64
+	Name string
+	Age  int
+}
+
+func TestWhereJoinsConditionsWithAnd(t *testing.T) {
+	cases := []struct {
+		q    *QueryBuilder
+		want string
+	}{
+		{GetQueryBuilder().Select(&testUser{}).Where("name", "x"), " WHERE name = ?"},
+		{GetQueryBuilder().Select(&testUser{}).Cond("id", ">", 1).Where("name", "x"), " WHERE id > ? AND name = ?"},
+		{GetQueryBuilder().Select(&testUser{}).WhereIn("id", []interface{}{1, 2}).Where("name", "x"), " WHERE id IN (?, ?) AND name = ?"},
+		{GetQueryBuilder().Select(&testUser{}).WhereNull("name").And("age", 1), " WHERE name IS NULL AND age = ?"},
+		{GetQueryBuilder().Select(&testUser{}).Like("name", "a%").Or("age", 1), " WHERE name LIKE ? OR age = ?"},
+		{GetQueryBuilder().Select(&testUser{}).Or("age", 1), " WHERE age = ?"},
+	}
+	for _, c := range cases {
+		if got := normalizeSpace(c.q.whereSql()); got != c.want {
+			t.Errorf("whereSql() = %q, want %q", got, c.want)
+		}
+	}
+	q := GetQueryBuilder().Select(&testUser{}).Cond("id", ">", 1).Where("name", "x")
+	if want := []interface{}{1, "x"}; !reflect.DeepEqual(q.args(), want) {
+		t.Errorf("args() = %v, want %v", q.args(), want)
+	}
+}
+
+// 合并连续的空格, 便于比较生成的 sql
+func normalizeSpace(s string) string {
+	lead := strings.HasPrefix(s, " ")
+	s = strings.Join(strings.Fields(s), " ")
+	if lead {
+		s = " " + s
+	}
+	return s
+}
+
+type testTicket struct {
+	Id       int64
+	Status   string  `db:",enum=open|closed"`
+	Priority *string `db:",enum=low|high"`
+}
+
+func TestEnumAllowsNilPointer(t *testing.T) {
+	if _, _, err := buildInsertSql(&testTicket{Status: "open"}); err != nil {
+		t.Fatalf("insert with nil enum pointer: %v", err)
+	}
+	if _, _, err := buildUpdateSql(&testTicket{Id: 1, Status: "open"}); err != nil {
+		t.Fatalf("update with nil enum pointer: %v", err)
+	}
+	bad := "urgent"
+	if _, _, err := buildInsertSql(&testTicket{Status: "open", Priority: &bad}); err == nil {
+		t.Fatal("expected error for a value outside the enum")
+	}
+}
+
+type testEvent struct {
+	Id        int64
+	CreatedAt time.Time
+}
+
+func TestTimeBindsSameForWriteAndWhere(t *testing.T) {
+	f := useFakeDB(t)
+	at := time.Date(2024, 5, 6, 7, 8, 9, 0, time.FixedZone("CST", 8*3600))
+	if _, err := InsertE(&testEvent{CreatedAt: at}); err != nil {
+		t.Fatal(err)
+	}
+	written, ok := f.lastExec().args[0].(time.Time)
+	if !ok {
+		t.Fatalf("insert bound %#v, want a time.Time", f.lastExec().args[0])
+	}
+	f.setRows([]string{"id", "createdAt"}, []driver.Value{int64(1), written})
+
+	arr, err := GetQueryBuilder().Select(&testEvent{}).Between("createdAt", at.Add(-time.Second), at).GetMany()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 驱动按同样的规则格式化写入的值和范围的边界, 写入的时间必须落在绑定的范围内
+	bounds := f.queries[len(f.queries)-1].args
+	low, ok := bounds[0].(time.Time)
+	high, ok2 := bounds[1].(time.Time)
+	if !ok || !ok2 || written.Before(low) || written.After(high) || written.Location() != high.Location() {
+		t.Fatalf("insert bound %v, range bound [%v, %v]", written, bounds[0], bounds[1])
+	}
+	if len(arr) != 1 || !arr[0].(*testEvent).CreatedAt.Equal(at) {
+		t.Fatalf("range query returned %v", arr)
+	}
+}
+
+type testCounter struct {
+	Id    uint64
+	Count uint32
+}
+
+func TestUint32RoundTrip(t *testing.T) {
+	f := useFakeDB(t)
+	if _, err := InsertE(&testCounter{Count: 4000000000}); err != nil {
+		t.Fatal(err)
+	}
+	args := f.lastExec().args
+	if len(args) != 1 || args[0] != int64(4000000000) {
+		t.Fatalf("insert args = %#v", args)
+	}
+	f.setRows([]string{"id", "count"}, []driver.Value{int64(1), args[0]})
+	got := new(testCounter)
+	if _, err := GetQueryBuilder().Select(got).Where("id", 1).GetOne(); err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != 1 || got.Count != 4000000000 {
+		t.Fatalf("read back %+v", got)
+	}
+}
+
+type testModelWithAVeryLongNameThatExceedsTheMySQLIdentifierLimitOf64Bytes struct {
+	Id int64
+}
+
+type testLongColumn struct {
+	Id   int64
+	Name string `db:"a_column_name_that_is_much_longer_than_the_mysql_limit_of_64_bytes"`
+}
+
+func TestDerivedIdentifierLength(t *testing.T) {
+	useFakeDB(t)
+	long := &testModelWithAVeryLongNameThatExceedsTheMySQLIdentifierLimitOf64Bytes{}
+	if _, _, err := buildInsertSql(long); err == nil {
+		t.Error("insert with a long table name: expected error")
+	}
+	if _, err := GetQueryBuilder().Select(long).GetMany(); err == nil {
+		t.Error("select with a long table name: expected error")
+	}
+	if _, _, err := buildUpdateSql(&testLongColumn{Id: 1}); err == nil {
+		t.Error("update with a long column name: expected error")
+	}
+	if _, _, err := buildDeleteSql(long); err == nil {
+		t.Error("delete with a long table name: expected error")
+	}
+}
+
+func benchmarkEach(b *testing.B, pooled bool) {
+	f := useFakeDB(b)
+	rows := make([][]driver.Value, 1000)
+	for i := range rows {
+		rows[i] = []driver.Value{int64(i), "name", int64(20)}
+	}
+	f.setRows([]string{"id", "name", "age"}, rows...)
+	oldLevel := LogLevel
+	LogLevel = LevelInfo
+	defer func() { LogLevel = oldLevel }()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q := GetQueryBuilder().Select(&testUser{})
+		if pooled {
+			q.Pooled()
+		}
+		if err := q.Each(func(row interface{}) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEach(b *testing.B) {
+	b.Run("unpooled", func(b *testing.B) { benchmarkEach(b, false) })
+	b.Run("pooled", func(b *testing.B) { benchmarkEach(b, true) })
+}
+
+// 改动前 sqlExec 的做法: 显式预处理, 执行后立即关闭(没有事务)
+func prepareExec(ctx context.Context, db *sql.DB, query string, values []interface{}) (sql.Result, error) {
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	return stmt.ExecContext(ctx, values...)
+}
+
+// 模拟每次往返 1ms 的网络延迟, 比较单条语句的执行方式
+func BenchmarkSingleStatementExec(b *testing.B) {
+	query, values, err := buildInsertSql(&testUser{Name: "a", Age: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, c := range []struct {
+		name        string
+		interpolate bool
+		exec        func() (sql.Result, error)
+	}{
+		{"prepare", false, func() (sql.Result, error) { return prepareExec(ctx, DB, query, values) }},
+		{"direct", false, func() (sql.Result, error) { return sqlExec(ctx, DB, query, values) }},
+		{"direct-interpolate", true, func() (sql.Result, error) { return sqlExec(ctx, DB, query, values) }},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			f := useFakeDB(b)
+			f.latency, f.interpolate = time.Millisecond, c.interpolate
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.exec(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&f.roundTrips))/float64(b.N), "roundtrips/op")
+		})
+	}
+}
+
+func TestUpdateSqlExcludesPrimaryKeyFromSet(t *testing.T) {
+	sqlStr, values, err := buildUpdateSql(&testUser{Id: 7, Name: "a", Age: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "UPDATE testUser SET name=?,age=? WHERE id = ?"; sqlStr != want {
+		t.Errorf("sql = %q, want %q", sqlStr, want)
+	}
+	set := sqlStr[strings.Index(sqlStr, " SET "):strings.Index(sqlStr, " WHERE ")]
+	if strings.Contains(set, "id=?") {
+		t.Errorf("SET list %q contains id=?", set)
+	}
+	if want := []interface{}{"a", int64(3), int64(7)}; !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %#v, want %#v", values, want)
+	}
+}
+
+func TestNonPointerScanTarget(t *testing.T) {
+	var columns []*fieldColumn
+	for _, c := range modelColumns(reflect.TypeOf(testUser{})) {
+		c := c
+		columns = append(columns, &c)
+	}
+	for _, target := range []interface{}{testUser{}, (*testUser)(nil)} {
+		_, err := getFieldsArray(target, columns)
+		if err == nil || !strings.Contains(err.Error(), "testUser") || !strings.Contains(err.Error(), "pointer") {
+			t.Errorf("getFieldsArray(%T) error = %v", target, err)
+		}
+	}
+
+	f := useFakeDB(t)
+	f.setRows([]string{"id", "name", "age"}, []driver.Value{int64(1), "a", int64(2)})
+	if _, err := GetQueryBuilder().Select(testUser{}).GetOne(); err == nil {
+		t.Error("GetOne with a non-pointer target: expected error")
+	}
+}
+
+func TestExecErrorPropagates(t *testing.T) {
+	f := useFakeDB(t)
+	f.execErr = errFake
+	if _, err := InsertE(&testUser{Name: "a"}); !errors.Is(err, errFake) {
+		t.Fatalf("InsertE error = %v, want the driver error", err)
+	}
+	if n := f.closes; n == 0 {
+		t.Error("prepared statement was not closed after the failed exec")
+	}
+}
+
+type testProfile struct {
+	Id       int64
+	Nickname sql.NullString
+}
+
+func TestNullStringRoundTrip(t *testing.T) {
+	f := useFakeDB(t)
+	for _, in := range []sql.NullString{{String: "neo", Valid: true}, {}} {
+		if _, err := InsertE(&testProfile{Nickname: in}); err != nil {
+			t.Fatal(err)
+		}
+		arg := f.lastExec().args[0]
+		var want driver.Value
+		if in.Valid {
+			want = in.String
+		}
+		if arg != want {
+			t.Fatalf("insert %+v bound %#v, want %#v", in, arg, want)
+		}
+		f.setRows([]string{"id", "nickname"}, []driver.Value{int64(1), arg})
+		got := new(testProfile)
+		if _, err := GetQueryBuilder().Select(got).Where("id", 1).GetOne(); err != nil {
+			t.Fatal(err)
+		}
+		if got.Nickname != in {
+			t.Fatalf("read back %+v, want %+v", got.Nickname, in)
+		}
+	}
+}
+
+type testJob struct {
+	Id      int64
+	Elapsed time.Duration
+	Timeout time.Duration `db:",unit=seconds"`
+}
+
+func TestDurationRoundTrip(t *testing.T) {
+	in := testJob{Elapsed: 1500 * time.Millisecond, Timeout: 90 * time.Second}
+	v := reflect.ValueOf(&in).Elem()
+	columns := modelColumns(v.Type())
+	want := map[string]int64{"elapsed": int64(1500 * time.Millisecond), "timeout": 90}
+	var out testJob
+	o := reflect.ValueOf(&out).Elem()
+	for _, c := range columns {
+		n, ok := want[c.name]
+		if !ok {
+			continue
+		}
+		stored := columnValue(c, v.FieldByIndex(c.field.Index))
+		if stored != n {
+			t.Errorf("%v stored as %#v, want %v", c.name, stored, n)
+		}
+		unit, _ := durationUnit(c.field)
+		// 驱动可能返回 int64 或文本协议下的 []byte
+		for _, src := range []interface{}{stored, []byte(strconv.FormatInt(n, 10))} {
+			s := &durationScanner{value: o.FieldByIndex(c.field.Index), unit: unit}
+			if err := s.Scan(src); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if out != in {
+		t.Errorf("read back %+v, want %+v", out, in)
+	}
+}
+
+func TestEachContextStopsWhenCanceled(t *testing.T) {
+	f := useFakeDB(t)
+	rows := make([][]driver.Value, 10)
+	for i := range rows {
+		rows[i] = []driver.Value{int64(i + 1), "a", int64(1)}
+	}
+	f.setRows([]string{"id", "name", "age"}, rows...)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	seen := 0
+	err := GetQueryBuilder().Select(&testUser{}).EachContext(ctx, func(row interface{}) error {
+		seen++
+		if seen == 3 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("EachContext error = %v, want context.Canceled", err)
+	}
+	if seen != 3 {
+		t.Errorf("callback ran %v times after cancel at 3", seen)
+	}
+}
+
+func TestGetManyReturnsRowsError(t *testing.T) {
+	f := useFakeDB(t)
+	f.setRows([]string{"id", "name", "age"}, []driver.Value{int64(1), "a", int64(1)})
+	f.rowsErr = context.Canceled
+	defer InvalidateCache("partial")
+	q := GetQueryBuilder().Select(&testUser{}).Cache("partial", time.Minute)
+	if arr, err := q.GetMany(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetMany = %v rows, %v, want context.Canceled", len(arr), err)
+	}
+	if _, ok := queryCache.get(q.cacheSlot("many")); ok {
+		t.Error("partial result was cached")
+	}
+}
+
+func TestGetManyReturnsScanError(t *testing.T) {
+	f := useFakeDB(t)
+	f.setRows([]string{"id", "name", "age"},
+		[]driver.Value{int64(1), "a", int64(1)},
+		[]driver.Value{int64(2), "b", "not a number"},
+	)
+	if arr, err := GetQueryBuilder().Select(&testUser{}).GetMany(); err == nil || !strings.Contains(err.Error(), "age") {
+		t.Fatalf("GetMany = %v rows, %v, want the scan error for age", len(arr), err)
+	}
+}
+
+func TestCountByKeysFollowColumnType(t *testing.T) {
+	f := useFakeDB(t)
+	f.types = []string{"INT", "BIGINT"}
+	// 文本协议下整数以 []byte 返回, 二进制协议下为 int64, 两者的键应当一致
+	for _, key := range []driver.Value{[]byte("1"), int64(1)} {
+		f.setRows([]string{"age", "count"}, []driver.Value{key, int64(3)}, []driver.Value{nil, int64(2)})
+		counts, err := GetQueryBuilder().Select(&testUser{}).CountBy("age")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts[int64(1)] != 3 || counts[nil] != 2 || len(counts) != 2 {
+			t.Errorf("CountBy with %#v = %v", key, counts)
+		}
+	}
+	f.types = []string{"VARCHAR", "BIGINT"}
+	f.setRows([]string{"name", "count"}, []driver.Value{[]byte("a"), int64(1)})
+	if counts, err := GetQueryBuilder().Select(&testUser{}).CountBy("name"); err != nil || counts["a"] != 1 {
+		t.Errorf("CountBy(name) = %v, %v", counts, err)
+	}
+}
+
+type testSettings struct {
+	Id    int64
+	Attrs map[string]string
+}
+
+func TestUnsupportedKinds(t *testing.T) {
+	f := useFakeDB(t)
+	if _, _, err := buildInsertSql(&testSettings{}); err == nil || !strings.Contains(err.Error(), "Attrs") {
+		t.Errorf("insert with a map field: error = %v", err)
+	}
+	f.setRows([]string{"id", "attrs"}, []driver.Value{int64(1), "x"})
+	old := StrictKinds
+	defer func() { StrictKinds = old }()
+	for _, strict := range []bool{true, false} {
+		StrictKinds = strict
+		if _, err := GetQueryBuilder().Select(&testSettings{}).GetOne(); err == nil || !strings.Contains(err.Error(), "Attrs") {
+			t.Errorf("StrictKinds %v: scanning a map field: error = %v", strict, err)
+		}
+	}
+}
+
+type testArticle struct {
+	Id       int64
+	Title    string
+	DeleteAt int64 `db:",softdelete"`
+}
+
+type testComment struct {
+	Id        int64
+	Body      string
+	IsDeleted bool `db:",softdelete_flag"`
+}
+
+func TestSoftDeleteScopeWrapsOrConditions(t *testing.T) {
+	cases := []struct {
+		q    *QueryBuilder
+		want string
+	}{
+		{GetQueryBuilder().Select(&testArticle{}).Where("title", "a").Or("title", "b"),
+			" WHERE deleteAt = 0 AND (title = ? OR title = ?)"},
+		{GetQueryBuilder().Select(&testComment{}).Sql("body = ? OR id = ?", "x", 1),
+			" WHERE isDeleted = 0 AND (body = ? OR id = ?)"},
+		{GetQueryBuilder().Select(&testComment{}), " WHERE isDeleted = 0"},
+	}
+	for _, c := range cases {
+		if got := normalizeSpace(c.q.whereSql()); got != c.want {
+			t.Errorf("whereSql() = %q, want %q", got, c.want)
+		}
+	}
+}
+
+type testDocument struct {
+	Id        int64
+	Hash      string
+	Value     string
+	UpdatedAt int64
+}
+
+func TestUpsertIfChangedGuardsEveryColumn(t *testing.T) {
+	sqlStr, _, err := buildUpsertSql(&testDocument{Id: 1, Hash: "h", Value: "v", UpdatedAt: 2}, "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hash 相同时每一列都赋值为自身, 行没有变化, ON UPDATE CURRENT_TIMESTAMP 的 updated_at 也不会更新
+	want := " ON DUPLICATE KEY UPDATE" +
+		" value = IF(hash <=> VALUES(hash), value, VALUES(value))," +
+		" updatedAt = IF(hash <=> VALUES(hash), updatedAt, VALUES(updatedAt))," +
+		" hash = VALUES(hash)"
+	if !strings.HasSuffix(sqlStr, want) {
+		t.Errorf("sql = %q, want suffix %q", sqlStr, want)
+	}
+	if _, _, err := buildUpsertSql(&testDocument{}, "missing"); err == nil {
+		t.Error("expected error for an unknown guard column")
+	}
+}
+
+type testUserSummary struct {
+	Id       int64
+	UserName string `db:"user_name"`
+	Orders   int64  `db:"order_count"`
+}
+
+func TestColumnAsMapsAliasesToTaggedFields(t *testing.T) {
+	f := useFakeDB(t)
+	q := GetQueryBuilder().Select(&testUserSummary{}).As("u").
+		Columns("u.id").ColumnAs("u.name", "user_name").ColumnAs("COUNT(*)", "order_count")
+	want := "SELECT `u`.`id`, `u`.`name` AS `user_name`, COUNT(*) AS `order_count` FROM `testUserSummary` AS `u`"
+	if got := normalizeSpace(q.baseSelectSql()); got != want {
+		t.Errorf("sql = %q, want %q", got, want)
+	}
+	f.setRows([]string{"id", "user_name", "order_count"}, []driver.Value{int64(1), "neo", int64(3)})
+	obj, err := q.GetOne()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := obj.(*testUserSummary); got.Id != 1 || got.UserName != "neo" || got.Orders != 3 {
+		t.Errorf("scanned %+v", got)
+	}
+}
+
+func TestAliasAndCorrelateValidateIdentifiers(t *testing.T) {
+	sub := GetQueryBuilder().Select(&testUser{}).As("o").Correlate("o.id", "u.id")
+	q := GetQueryBuilder().Select(&testUser{}).As("u").WhereExists(sub)
+	want := " WHERE EXISTS (SELECT 1 FROM `testUser` AS `o` WHERE `o`.`id` = `u`.`id`)"
+	if got := normalizeSpace(q.whereSql()); got != want {
+		t.Errorf("whereSql() = %q, want %q", got, want)
+	}
+	for _, q := range []*QueryBuilder{
+		GetQueryBuilder().Select(&testUser{}).As("u; DROP TABLE x"),
+		GetQueryBuilder().Select(&testUser{}).As("a.b"),
+		GetQueryBuilder().Select(&testUser{}).Correlate("o.id", "1 OR 1=1"),
+		GetQueryBuilder().Select(&testUser{}).Correlate("o.id)--", "u.id"),
+	} {
+		if q.err == nil {
+			t.Errorf("expected error for %q", q.whereSql())
+		}
+	}
+
+	f := useFakeDB(t)
+	f.setRows([]string{"id", "name", "age"}, []driver.Value{int64(1), "a", int64(2)})
+	bad := GetQueryBuilder().Select(&testUser{}).As("o").Correlate("o.id", "1 OR 1=1")
+	if _, err := GetQueryBuilder().Select(&testUser{}).As("u").WhereExists(bad).GetMany(); err == nil {
+		t.Error("WhereExists with an invalid subquery: expected error")
+	}
+}
+
+func TestDeleteByKeysFallsBackToDefaultChunkSize(t *testing.T) {
+	f := useFakeDB(t)
+	old := DeleteChunkSize
+	defer func() { DeleteChunkSize = old }()
+	keys := [][]interface{}{{1}, {2}, {3}}
+	for _, size := range []int{0, -1} {
+		DeleteChunkSize = size
+		n, err := DeleteByKeys(&testUser{}, keys)
+		if err != nil || n != 1 {
+			t.Fatalf("DeleteChunkSize %v: DeleteByKeys = %v, %v", size, n, err)
+		}
+		if args := f.lastExec().args; len(args) != len(keys) {
+			t.Fatalf("DeleteChunkSize %v: one statement bound %v keys, want %v", size, len(args), len(keys))
+		}
+	}
+}
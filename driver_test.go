@@ -0,0 +1,228 @@
+package golibs
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 测试用的 database/sql 驱动, 不连接真正的数据库
+// 查询返回 fakeDB.columns/rows 中预设的结果, 写操作记录下执行的语句和参数
+type fakeDB struct {
+	mu       sync.Mutex
+	columns  []string
+	types    []string // 列的数据库类型, 如 INT、VARCHAR, 为空时不报告
+	rows     [][]driver.Value
+	execErr  error // 写操作返回的错误
+	commit   error // 提交事务返回的错误
+	rowsErr  error // 查询遍历完预设的行后返回的错误, 模拟遍历途中取消或断开
+	execs    []fakeExec
+	queries  []fakeExec
+	prepares int64
+	closes   int64 // 关闭的预处理语句数
+
+	latency     time.Duration // 模拟每次与服务端往返的延迟
+	interpolate bool          // 模拟 interpolateParams=true, 语句直接执行而不预处理
+	roundTrips  int64
+}
+
+// 预处理和执行各需要一次往返, 关闭预处理语句不等待服务端响应
+func (f *fakeDB) roundTrip() {
+	atomic.AddInt64(&f.roundTrips, 1)
+	if f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+}
+
+type fakeExec struct {
+	query string
+	args  []driver.Value
+}
+
+func (f *fakeDB) setRows(columns []string, rows ...[]driver.Value) {
+	f.mu.Lock()
+	f.columns, f.rows = columns, rows
+	f.mu.Unlock()
+}
+
+func (f *fakeDB) lastExec() fakeExec {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.execs) == 0 {
+		return fakeExec{}
+	}
+	return f.execs[len(f.execs)-1]
+}
+
+var (
+	fakeMu  sync.Mutex
+	fakeDBs = map[string]*fakeDB{}
+	fakeSeq int64
+)
+
+func init() {
+	sql.Register("golibs-fake", fakeDriver{})
+}
+
+// 打开一个新的测试连接池, 测试结束时关闭
+func newFakeDB(t testing.TB) (*sql.DB, *fakeDB) {
+	f := new(fakeDB)
+	name := fmt.Sprintf("fake-%d", atomic.AddInt64(&fakeSeq, 1))
+	fakeMu.Lock()
+	fakeDBs[name] = f
+	fakeMu.Unlock()
+	db, err := sql.Open("golibs-fake", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, f
+}
+
+// 把全局的 DB 替换为测试连接池, 测试结束时恢复
+func useFakeDB(t testing.TB) *fakeDB {
+	db, f := newFakeDB(t)
+	old := DB
+	DB = db
+	t.Cleanup(func() { DB = old })
+	return f
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeMu.Lock()
+	defer fakeMu.Unlock()
+	f, ok := fakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown fake db %q", name)
+	}
+	return &fakeConn{db: f}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	atomic.AddInt64(&c.db.prepares, 1)
+	c.db.roundTrip()
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+// 没有开启 interpolate 时返回 driver.ErrSkip, database/sql 退回到预处理再执行
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !c.db.interpolate {
+		return nil, driver.ErrSkip
+	}
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	return (&fakeStmt{db: c.db, query: query}).Exec(values)
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return &fakeTx{db: c.db}, nil }
+
+type fakeTx struct {
+	db *fakeDB
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	return tx.db.commit
+}
+
+func (tx *fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	atomic.AddInt64(&s.db.closes, 1)
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.roundTrip()
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.db.execErr != nil {
+		return nil, s.db.execErr
+	}
+	s.db.execs = append(s.db.execs, fakeExec{query: s.query, args: args})
+	return fakeResult(len(s.db.execs)), nil
+}
+
+// 每次写操作影响一行, 自增 id 为执行的序号
+type fakeResult int64
+
+func (r fakeResult) LastInsertId() (int64, error) { return int64(r), nil }
+
+func (r fakeResult) RowsAffected() (int64, error) { return 1, nil }
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.queries = append(s.db.queries, fakeExec{query: s.query, args: args})
+	return &fakeRows{columns: s.db.columns, types: s.db.types, rows: s.db.rows, err: s.db.rowsErr}, nil
+}
+
+// 支持 ctx 的查询, 便于测试在遍历途中取消
+func (s *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	return s.Query(values)
+}
+
+type fakeRows struct {
+	columns []string
+	types   []string
+	rows    [][]driver.Value
+	next    int
+	err     error
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) ColumnTypeDatabaseTypeName(i int) string {
+	if i < len(r.types) {
+		return r.types[i]
+	}
+	return ""
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		if r.err != nil {
+			return r.err
+		}
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+var errFake = errors.New("fake driver error")
@@ -0,0 +1,128 @@
+package golibs
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// 根据主键批量查询, 返回主键值到记录的映射, 不存在的主键不会出现在结果中
+// 所有记录一次查询取回, 避免逐个查询的 N+1 问题.
+// 映射的键为调用方传入的主键值, 例如 FindByIDs[User](1, 2) 的结果可以直接用 m[1] 取出;
+// []byte 主键(如 BINARY(16) 的 UUID)以 string 作为键.
+func FindByIDs[T any](ids ...interface{}) (map[interface{}]*T, error) {
+	result := make(map[interface{}]*T)
+	if len(ids) == 0 {
+		return result, nil
+	}
+	// 按 mapKey 转换后的主键到调用方传入的值
+	wanted := make(map[interface{}]interface{}, len(ids))
+	for _, id := range ids {
+		k, err := mapKey(id)
+		if err != nil {
+			return nil, err
+		}
+		if reflect.ValueOf(id).Kind() == reflect.Slice {
+			id = k
+		}
+		wanted[k] = id
+	}
+	q := GetQueryBuilder().Select(new(T)).WhereIn(PrimaryKey, ids)
+	err := q.Each(func(row interface{}) error {
+		pk, err := PrimaryKeyValue(row)
+		if err != nil {
+			return err
+		}
+		k, err := mapKey(pk)
+		if err != nil {
+			return err
+		}
+		if id, ok := wanted[k]; ok {
+			k = id
+		}
+		result[k] = row.(*T)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// 查询一条记录, 没有查到时返回 def 而不是 ErrNotFound, 只有真正的错误才返回 error
+// q 需要以 Select(&T{}) 构造
+func QueryOneOrDefault[T any](q *QueryBuilder, def T) (T, error) {
+	obj, err := q.GetOne()
+	if err == ErrNotFound {
+		return def, nil
+	}
+	if err != nil {
+		return def, err
+	}
+	row, ok := obj.(*T)
+	if !ok {
+		return def, fmt.Errorf("query target is %T, not *%T", obj, def)
+	}
+	return *row, nil
+}
+
+// 查询所有记录并在内存中按 keyColumn 列的值分组, 返回完整的记录而不是聚合结果
+// keyColumn 必须对应 T 的一个字段, 键按 mapKey 转换: 整型统一为 int64, []byte 转为 string
+func GroupByColumn[T any](q *QueryBuilder, keyColumn string) (map[interface{}][]*T, error) {
+	var key *fieldColumn
+	for _, c := range modelColumns(q.typ) {
+		if strings.EqualFold(c.name, keyColumn) {
+			c := c
+			key = &c
+			break
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("column %v is not mapped to a field of %v", keyColumn, q.typ.Name())
+	}
+	// 结果需要保留每一行, 不能复用行结构体
+	q.pooled = false
+	groups := make(map[interface{}][]*T)
+	err := q.Each(func(row interface{}) error {
+		obj, ok := row.(*T)
+		if !ok {
+			return fmt.Errorf("query target is %T, not %T", row, obj)
+		}
+		k, err := mapKey(columnValue(*key, reflect.ValueOf(obj).Elem().FieldByIndex(key.field.Index)))
+		if err != nil {
+			return err
+		}
+		groups[k] = append(groups[k], obj)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// 转换为可以作为 map 键的值: 整型统一为 int64 (超出 int64 范围的无符号整数为 uint64),
+// []byte 转为 string, 其他不可比较的类型返回错误
+func mapKey(v interface{}) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return nil, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if u := rv.Uint(); u > math.MaxInt64 {
+			return u, nil
+		}
+		return int64(rv.Uint()), nil
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return string(rv.Bytes()), nil
+		}
+	}
+	if !rv.Type().Comparable() {
+		return nil, fmt.Errorf("value of type %T can not be used as a map key", v)
+	}
+	return v, nil
+}
@@ -0,0 +1,78 @@
+package golibs
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+type testDevice struct {
+	Id   []byte
+	Name string
+}
+
+func TestFindByIDsKeysByCallerValues(t *testing.T) {
+	f := useFakeDB(t)
+	f.setRows([]string{"id", "name", "age"},
+		[]driver.Value{int64(1), "a", int64(20)},
+		[]driver.Value{int64(2), "b", int64(30)},
+	)
+	m, err := FindByIDs[testUser](1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m[1] == nil || m[1].Name != "a" || m[2] == nil || m[2].Name != "b" {
+		t.Fatalf("FindByIDs(1, 2) = %v", m)
+	}
+}
+
+func TestFindByIDsBytesKey(t *testing.T) {
+	f := useFakeDB(t)
+	f.setRows([]string{"id", "name"},
+		[]driver.Value{[]byte{0x01, 0x02}, "a"},
+	)
+	m, err := FindByIDs[testDevice]([]byte{0x01, 0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := m[string([]byte{0x01, 0x02})]; d == nil || d.Name != "a" {
+		t.Fatalf("FindByIDs([]byte) = %v", m)
+	}
+}
+
+func TestMapKey(t *testing.T) {
+	cases := []struct {
+		in, want interface{}
+	}{
+		{1, int64(1)},
+		{uint32(7), int64(7)},
+		{uint64(1 << 63), uint64(1 << 63)},
+		{[]byte("ab"), "ab"},
+		{"x", "x"},
+		{nil, nil},
+	}
+	for _, c := range cases {
+		got, err := mapKey(c.in)
+		if err != nil || got != c.want {
+			t.Errorf("mapKey(%#v) = %#v, %v, want %#v", c.in, got, err, c.want)
+		}
+	}
+	if _, err := mapKey([]int{1}); err == nil {
+		t.Error("expected error for an unhashable key")
+	}
+}
+
+func TestGroupByColumnBytesKey(t *testing.T) {
+	f := useFakeDB(t)
+	f.setRows([]string{"id", "name"},
+		[]driver.Value{[]byte{0x01}, "a"},
+		[]driver.Value{[]byte{0x01}, "b"},
+		[]driver.Value{[]byte{0x02}, "c"},
+	)
+	groups, err := GroupByColumn[testDevice](GetQueryBuilder().Select(&testDevice{}), "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || len(groups["\x01"]) != 2 || len(groups["\x02"]) != 1 {
+		t.Fatalf("GroupByColumn = %v", groups)
+	}
+}
@@ -2,4 +2,4 @@ require github.com/go-sql-driver/mysql v1.5.0
 
 module github.com/icharm/golibs
 
-go 1.14
+go 1.18
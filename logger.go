@@ -1,45 +1,250 @@
 package golibs
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// 包内部使用的日志接口, 默认由 Logger 实现, 可以通过 SetLogger 替换
 type Log interface {
-	INFO()
-	ERROR()
-	Error()
-	WARN()
-	DEBUG()
+	INFO(content string, a ...interface{})
+	ERROR(content string, a ...interface{})
+	Error(err error)
+	WARN(content string, a ...interface{})
+	DEBUG(content string, a ...interface{})
 }
 
+// 替换包内部使用的日志, 传入 nil 时恢复默认的 Logger
+func SetLogger(l Log) {
+	if l == nil {
+		l = new(Logger)
+	}
+	logger = l
+}
+
+// 日志级别, 低于 Logger 级别的日志不输出
+type Level int
+
+const (
+	LevelDebug Level = iota + 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (lv Level) String() string {
+	switch lv {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "Level(" + strconv.Itoa(int(lv)) + ")"
+}
+
+// 按名称(不区分大小写)解析日志级别, 例如 "info"
+func ParseLevel(s string) (Level, error) {
+	for lv := LevelDebug; lv <= LevelError; lv++ {
+		if strings.EqualFold(s, lv.String()) {
+			return lv, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// 未设置 Level 的 Logger(包括包内部默认使用的 logger)的日志级别
+// 初始值取自环境变量 GOLIBS_LOG_LEVEL, 未设置或无法识别时为 LevelDebug, 即全部输出.
+// 生产环境可以设为 LevelInfo 关闭 DEBUG 级别的 sql 日志.
+var LogLevel = levelFromEnv()
+
+func levelFromEnv() Level {
+	if lv, err := ParseLevel(os.Getenv("GOLIBS_LOG_LEVEL")); err == nil {
+		return lv
+	}
+	return LevelDebug
+}
+
+// Logger.Format 的取值, 每行输出一个 JSON 对象, 便于日志采集系统解析
+const FormatJSON = "json"
+
 type Logger struct {
+	// 输出格式, 默认为可读的文本格式, 设为 FormatJSON 时输出 JSON
 	Format string
+	// 最低输出级别, 为 0 时使用包级别的 LogLevel
+	Level Level
+	// 日志输出位置, 例如文件或测试用的 bytes.Buffer
+	// 为 nil 时使用标准库 log 包的输出(默认为 os.Stderr, 可以通过 log.SetOutput 修改)
+	Out io.Writer
+	// 附加字段的输出顺序, 列出的字段排在前面, 其余按添加顺序输出
+	FieldOrder []string
+	// 每行日志附加一个 log_id 字段, 便于定位某一次具体的输出
+	LogID bool
+	// 在函数名之后输出调用处的 file:line, 需要额外解析调用栈, 默认关闭
+	FileLine bool
+	fields   []Field
+}
+
+var logSeq uint64
+
+// 进程内递增的日志编号, 以 36 进制输出保持简短
+func nextLogID() string {
+	return strconv.FormatUint(atomic.AddUint64(&logSeq, 1), 36)
+}
+
+// 串行化写入 Out 的日志, 多个 goroutine 可以共用同一个 Out (如 bytes.Buffer)
+var outMu sync.Mutex
+
+// 日志附加字段
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// 返回带有附加字段的 Logger, 原 Logger 不受影响
+// 字段按添加顺序输出, 同一事件每次输出的格式都相同, 便于阅读和 grep
+func (l Logger) With(key string, value interface{}) Logger {
+	fields := make([]Field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	l.fields = append(fields, Field{Key: key, Value: value})
+	return l
 }
 
 func (l Logger) INFO(content string, a ...interface{}) {
-	l.output("[INFO]", content, a...)
+	l.output(LevelInfo, content, a...)
 }
 
 func (l Logger) ERROR(content string, a ...interface{}) {
-	l.output("[ERROR]", content, a...)
+	l.output(LevelError, content, a...)
 }
 
 func (l Logger) Error(err error) {
-	l.output("[ERROR]", err.Error())
+	l.output(LevelError, err.Error())
 }
 
 func (l Logger) WARN(content string, a ...interface{}) {
-	l.output("[WARN]", content, a...)
+	l.output(LevelWarn, content, a...)
 }
 
 func (l Logger) DEBUG(content string, a ...interface{}) {
-	l.output("[DEBUG]", content, a...)
+	l.output(LevelDebug, content, a...)
 }
 
-func (l Logger) output(level string, content string, a ...interface{}) {
-	pc, _, _, _ := runtime.Caller(2)
+func (l Logger) output(level Level, content string, a ...interface{}) {
+	threshold := l.Level
+	if threshold == 0 {
+		threshold = LogLevel
+	}
+	if level < threshold {
+		return
+	}
+	pc, file, line, _ := runtime.Caller(2)
 	method := runtime.FuncForPC(pc).Name()
-	log.Printf(fmt.Sprintf(level+":["+method+"]: "+content+" \n", a...))
+	if l.Format == FormatJSON {
+		l.outputJSON(level, method, file, line, fmt.Sprintf(content, a...))
+		return
+	}
+	if l.FileLine {
+		method += " " + file + ":" + strconv.Itoa(line)
+	}
+	msg := fmt.Sprintf("["+level.String()+"]:["+method+"]: "+content, a...) + l.formatFields() + " \n"
+	if l.Out == nil {
+		log.Print(msg)
+		return
+	}
+	outMu.Lock()
+	defer outMu.Unlock()
+	log.New(l.Out, "", log.LstdFlags).Print(msg)
+}
+
+// 输出一行 JSON, 依次为 timestamp/level/method/(file/line)/message 和附加字段
+func (l Logger) outputJSON(level Level, method, file string, line int, message string) {
+	fields := []Field{
+		{Key: "timestamp", Value: time.Now().Format(time.RFC3339Nano)},
+		{Key: "level", Value: level.String()},
+		{Key: "method", Value: method},
+	}
+	if l.FileLine {
+		fields = append(fields, Field{Key: "file", Value: file}, Field{Key: "line", Value: line})
+	}
+	fields = append(fields, Field{Key: "message", Value: message})
+	fields = append(fields, l.extraFields()...)
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.Key)
+		value, err := json.Marshal(f.Value)
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(f.Value))
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteString("}\n")
+	out := l.Out
+	if out == nil {
+		out = log.Writer()
+	}
+	outMu.Lock()
+	defer outMu.Unlock()
+	out.Write(b.Bytes())
+}
+
+// 按 FieldOrder 和添加顺序排列附加字段
+func (l Logger) orderedFields() []Field {
+	if len(l.FieldOrder) == 0 {
+		return l.fields
+	}
+	ordered := make([]Field, 0, len(l.fields))
+	used := make([]bool, len(l.fields))
+	for _, key := range l.FieldOrder {
+		for i, f := range l.fields {
+			if !used[i] && f.Key == key {
+				ordered = append(ordered, f)
+				used[i] = true
+			}
+		}
+	}
+	for i, f := range l.fields {
+		if !used[i] {
+			ordered = append(ordered, f)
+		}
+	}
+	return ordered
+}
+
+// 排好序的附加字段, 开启 LogID 时最后加上 log_id
+func (l Logger) extraFields() []Field {
+	fields := l.orderedFields()
+	if l.LogID {
+		fields = append(fields[:len(fields):len(fields)], Field{Key: "log_id", Value: nextLogID()})
+	}
+	return fields
+}
+
+// 以 key=value 的形式输出附加字段
+func (l Logger) formatFields() string {
+	var b strings.Builder
+	for _, f := range l.extraFields() {
+		b.WriteString(fmt.Sprintf(" %v=%v", f.Key, f.Value))
+	}
+	return b.String()
 }
@@ -0,0 +1,63 @@
+//go:build go1.21
+
+package golibs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// 把包内部的日志输出到 slog, INFO/WARN/ERROR/DEBUG 对应 slog 的同名级别
+// 附加字段用 With 添加, 作为 slog 的属性输出. 传入 nil 时恢复默认的 Logger
+func SetSlogHandler(l *slog.Logger) {
+	if l == nil {
+		SetLogger(nil)
+		return
+	}
+	SetLogger(SlogLogger{logger: l})
+}
+
+// 基于 slog 的 Log 实现
+type SlogLogger struct {
+	logger *slog.Logger
+}
+
+// 返回带有附加属性的 SlogLogger, 原 SlogLogger 不受影响
+func (l SlogLogger) With(key string, value interface{}) SlogLogger {
+	return SlogLogger{logger: l.logger.With(key, value)}
+}
+
+func (l SlogLogger) INFO(content string, a ...interface{}) {
+	l.output(slog.LevelInfo, content, a...)
+}
+
+func (l SlogLogger) ERROR(content string, a ...interface{}) {
+	l.output(slog.LevelError, content, a...)
+}
+
+func (l SlogLogger) Error(err error) {
+	l.output(slog.LevelError, "%v", err)
+}
+
+func (l SlogLogger) WARN(content string, a ...interface{}) {
+	l.output(slog.LevelWarn, content, a...)
+}
+
+func (l SlogLogger) DEBUG(content string, a ...interface{}) {
+	l.output(slog.LevelDebug, content, a...)
+}
+
+// 直接构造 Record, 让 slog 记录的源码位置是调用日志方法的地方而不是这里
+func (l SlogLogger) output(level slog.Level, content string, a ...interface{}) {
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+	r := slog.NewRecord(time.Now(), level, fmt.Sprintf(content, a...), pcs[0])
+	_ = l.logger.Handler().Handle(ctx, r)
+}
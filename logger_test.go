@@ -0,0 +1,33 @@
+package golibs
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLoggerConcurrentWritesToSharedOut(t *testing.T) {
+	var buf bytes.Buffer
+	text := Logger{Out: &buf, Level: LevelDebug}
+	json := Logger{Out: &buf, Level: LevelDebug, Format: FormatJSON}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			text.INFO("text %v", i)
+			json.INFO("json %v", i)
+		}(i)
+	}
+	wg.Wait()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 40 {
+		t.Fatalf("got %v lines, want 40", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "[INFO]") && !strings.HasPrefix(line, "{") {
+			t.Errorf("interleaved line %q", line)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package golibs
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// 各类字段可以兼容的 MySQL 列类型 (INFORMATION_SCHEMA.COLUMNS.DATA_TYPE)
+var (
+	intColumnTypes    = []string{"tinyint", "smallint", "mediumint", "int", "integer", "bigint", "year", "bit"}
+	floatColumnTypes  = []string{"float", "double", "decimal"}
+	boolColumnTypes   = []string{"tinyint", "bit", "boolean"}
+	stringColumnTypes = []string{"char", "varchar", "tinytext", "text", "mediumtext", "longtext",
+		"enum", "set", "json", "decimal", "date", "datetime", "timestamp", "time"}
+	timeColumnTypes  = []string{"date", "datetime", "timestamp"}
+	bytesColumnTypes = []string{"binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob",
+		"char", "varchar", "tinytext", "text", "mediumtext", "longtext", "json"}
+)
+
+// 对照数据库中的表结构检查模型, 只读不修改任何数据
+// 检查模型映射的每一列在表中都存在, 且列类型与字段类型大致兼容(例如 int64 字段对应整数列),
+// 不一致时返回列出所有问题的错误. 适合在程序启动时调用, 尽早发现映射错误.
+func ValidateSchema(st interface{}) error {
+	t := reflect.TypeOf(st)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return errors.New("param type is not Struct")
+	}
+	table := tableName(t)
+	if DB == nil {
+		return ErrNotInitialized
+	}
+
+	rows, err := DB.Query("SELECT COLUMN_NAME, DATA_TYPE FROM INFORMATION_SCHEMA.COLUMNS "+
+		"WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	dbTypes := make(map[string]string)
+	for rows.Next() {
+		var name, dataType string
+		if err := rows.Scan(&name, &dataType); err != nil {
+			return err
+		}
+		dbTypes[strings.ToLower(name)] = strings.ToLower(dataType)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(dbTypes) == 0 {
+		return fmt.Errorf("table %v does not exist", table)
+	}
+
+	var problems []string
+	for _, c := range modelColumns(t) {
+		dataType, ok := dbTypes[strings.ToLower(c.name)]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("column %v not found", c.name))
+			continue
+		}
+		// 指针字段对应可以为 NULL 的列, 按指向的类型检查
+		typ := c.field.Type
+		if typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		if allowed := compatibleColumnTypes(typ); allowed != nil && !containsString(allowed, dataType) {
+			problems = append(problems, fmt.Sprintf("column %v is %v, not compatible with field %v %v",
+				c.name, dataType, c.field.Name, c.field.Type))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("model %v does not match table %v: %v", t.Name(), table, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// 字段类型可以兼容的列类型, 返回 nil 表示不检查
+func compatibleColumnTypes(t reflect.Type) []string {
+	if t == timeType {
+		return timeColumnTypes
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return intColumnTypes
+	case reflect.Float32, reflect.Float64:
+		return floatColumnTypes
+	case reflect.Bool:
+		return boolColumnTypes
+	case reflect.String:
+		return stringColumnTypes
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return bytesColumnTypes
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+func containsString(arr []string, s string) bool {
+	for _, a := range arr {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 根据模型生成建表语句并执行, 表已存在时不做任何修改
+func CreateTable(st interface{}) error {
+	sqlStr, err := CreateTableSql(st)
+	if err != nil {
+		return err
+	}
+	if DB == nil {
+		return ErrNotInitialized
+	}
+	_, err = DB.Exec(sqlStr)
+	return err
+}
+
+// 根据模型生成 CREATE TABLE 语句
+// 主键列为自增的 BIGINT, 指针字段的列可为 NULL, 其余列 NOT NULL.
+// 外键在引用列上用 fk 选项声明, 可以附带 ON DELETE / ON UPDATE 动作:
+//
+//	userId int64 `db:",fk=users(id) on delete cascade on update restrict"`
+func CreateTableSql(st interface{}) (string, error) {
+	t := reflect.TypeOf(st)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return "", errors.New("param type is not Struct")
+	}
+	table := tableName(t)
+	quotedTable, err := quoteIdent(table)
+	if err != nil {
+		return "", err
+	}
+	var defs, constraints []string
+	for _, c := range modelColumns(t) {
+		name, err := quoteIdent(c.name)
+		if err != nil {
+			return "", err
+		}
+		if c.name == PrimaryKey {
+			defs = append(defs, name+" BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY")
+			continue
+		}
+		defs = append(defs, name+" "+columnDefinition(c.field))
+		if ref, ok := tagOptions(c.field)["fk"]; ok {
+			fk, err := foreignKeySql(ref)
+			if err != nil {
+				return "", fmt.Errorf("field %v: %w", c.field.Name, err)
+			}
+			constraints = append(constraints, "CONSTRAINT `fk_"+table+"_"+c.name+"` FOREIGN KEY ("+name+") "+fk)
+		}
+	}
+	return "CREATE TABLE IF NOT EXISTS " + quotedTable + " (\n  " +
+		strings.Join(append(defs, constraints...), ",\n  ") + "\n)", nil
+}
+
+// 字段对应的列定义, 不含列名
+func columnDefinition(f reflect.StructField) string {
+	typ, null := f.Type, " NOT NULL"
+	if typ.Kind() == reflect.Ptr {
+		typ, null = typ.Elem(), " NULL"
+	}
+	opts := tagOptions(f)
+	if members, ok := opts["enum"]; ok {
+		return "ENUM('" + strings.Join(strings.Split(members, "|"), "','") + "')" + null
+	}
+	_, soft := opts["softdelete"]
+	_, flag := opts["softdelete_flag"]
+	if soft || flag {
+		null += " DEFAULT 0"
+	}
+	return columnType(typ) + null
+}
+
+// Go 类型对应的 MySQL 列类型
+func columnType(t reflect.Type) string {
+	if t == durationType {
+		return "BIGINT"
+	}
+	if t == timeType {
+		return "DATETIME(6)"
+	}
+	switch t.Kind() {
+	case reflect.Int8:
+		return "TINYINT"
+	case reflect.Int16:
+		return "SMALLINT"
+	case reflect.Int32:
+		return "INT"
+	case reflect.Int, reflect.Int64:
+		return "BIGINT"
+	case reflect.Uint8:
+		return "TINYINT UNSIGNED"
+	case reflect.Uint16:
+		return "SMALLINT UNSIGNED"
+	case reflect.Uint32:
+		return "INT UNSIGNED"
+	case reflect.Uint, reflect.Uint64:
+		return "BIGINT UNSIGNED"
+	case reflect.Float32:
+		return "FLOAT"
+	case reflect.Float64:
+		return "DOUBLE"
+	case reflect.Bool:
+		return "TINYINT(1)"
+	case reflect.String:
+		return "VARCHAR(255)"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "BLOB"
+		}
+		return "TEXT"
+	default:
+		return "TEXT"
+	}
+}
+
+// 外键允许的引用动作
+var referentialActions = []string{"CASCADE", "RESTRICT", "SET NULL", "NO ACTION", "SET DEFAULT"}
+
+// 解析 fk 选项, 格式为 table(column) [on delete 动作] [on update 动作]
+// 返回 REFERENCES 子句
+func foreignKeySql(ref string) (string, error) {
+	open, end := strings.Index(ref, "("), strings.Index(ref, ")")
+	if open <= 0 || end < open {
+		return "", fmt.Errorf("invalid fk %q, expect table(column)", ref)
+	}
+	table, err := quoteIdent(strings.TrimSpace(ref[:open]))
+	if err != nil {
+		return "", fmt.Errorf("invalid fk %q: %w", ref, err)
+	}
+	column, err := quoteIdent(strings.TrimSpace(ref[open+1 : end]))
+	if err != nil {
+		return "", fmt.Errorf("invalid fk %q: %w", ref, err)
+	}
+	sqlStr := "REFERENCES " + table + " (" + column + ")"
+
+	words := strings.Fields(strings.ToUpper(ref[end+1:]))
+	seen := make(map[string]bool)
+	for len(words) > 0 {
+		if len(words) < 3 || words[0] != "ON" || (words[1] != "DELETE" && words[1] != "UPDATE") {
+			return "", fmt.Errorf("invalid fk %q, expect on delete/on update action", ref)
+		}
+		event := words[1]
+		if seen[event] {
+			return "", fmt.Errorf("invalid fk %q, duplicate on %v", ref, strings.ToLower(event))
+		}
+		seen[event] = true
+		action := words[2]
+		n := 3
+		if len(words) > 3 && (action == "SET" || action == "NO") {
+			action += " " + words[3]
+			n = 4
+		}
+		if !containsString(referentialActions, action) {
+			return "", fmt.Errorf("invalid fk %q, unknown action %v", ref, strings.ToLower(action))
+		}
+		sqlStr += " ON " + event + " " + action
+		words = words[n:]
+	}
+	return sqlStr, nil
+}
+
+// 数据库中是否存在该表, 表名可以写成 db.table, 否则在当前数据库中查找
+// 用于启动时手写的幂等迁移, 例如表不存在时才执行 CREATE TABLE
+func HasTable(table string) (bool, error) {
+	schema, name, err := splitTableName(table)
+	if err != nil {
+		return false, err
+	}
+	if DB == nil {
+		return false, ErrNotInitialized
+	}
+	var n int
+	err = DB.QueryRow("SELECT COUNT(*) FROM INFORMATION_SCHEMA.TABLES "+
+		"WHERE TABLE_SCHEMA = "+schema+" AND TABLE_NAME = ?", name).Scan(&n)
+	return n > 0, err
+}
+
+// 表中是否存在该列, 表名规则同 HasTable, 表不存在时返回 false
+// 用于启动时手写的幂等迁移, 例如列不存在时才执行 ALTER TABLE ... ADD COLUMN
+func HasColumn(table, column string) (bool, error) {
+	schema, name, err := splitTableName(table)
+	if err != nil {
+		return false, err
+	}
+	if _, err := quoteIdent(column); err != nil {
+		return false, err
+	}
+	if DB == nil {
+		return false, ErrNotInitialized
+	}
+	var n int
+	err = DB.QueryRow("SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS "+
+		"WHERE TABLE_SCHEMA = "+schema+" AND TABLE_NAME = ? AND COLUMN_NAME = ?", name, column).Scan(&n)
+	return n > 0, err
+}
+
+// 校验表名并拆分出库名, 返回用于 TABLE_SCHEMA 条件的 sql 片段和表名
+func splitTableName(table string) (string, string, error) {
+	if _, err := quoteIdent(table); err != nil {
+		return "", "", err
+	}
+	if i := strings.Index(table, "."); i >= 0 {
+		if strings.Contains(table[i+1:], ".") {
+			return "", "", fmt.Errorf("invalid table name: %q", table)
+		}
+		return "'" + table[:i] + "'", table[i+1:], nil
+	}
+	return "DATABASE()", table, nil
+}
@@ -0,0 +1,31 @@
+package golibs
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+type testAccount struct {
+	Id    int64
+	Score *int
+}
+
+func TestValidateSchemaChecksPointerFields(t *testing.T) {
+	f := useFakeDB(t)
+	f.setRows([]string{"COLUMN_NAME", "DATA_TYPE"},
+		[]driver.Value{"id", "bigint"},
+		[]driver.Value{"score", "varchar"},
+	)
+	err := ValidateSchema(&testAccount{})
+	if err == nil || !strings.Contains(err.Error(), "column score is varchar") {
+		t.Fatalf("ValidateSchema error = %v, want a mismatch for score", err)
+	}
+	f.setRows([]string{"COLUMN_NAME", "DATA_TYPE"},
+		[]driver.Value{"id", "bigint"},
+		[]driver.Value{"score", "int"},
+	)
+	if err := ValidateSchema(&testAccount{}); err != nil {
+		t.Fatalf("ValidateSchema with a nullable int column: %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package golibs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// 依次执行多条语句, 遇到第一个错误即停止, 错误中指明失败的是第几条语句
+// 用于初始化表结构和测试数据. mysql 驱动默认不允许一次 Exec 多条语句
+// (需要在连接字符串中加 multiStatements=true, 且会让 sql 注入的危害更大),
+// 这里逐条执行, 不依赖该选项. 脚本可以先用 SplitStatements 拆分.
+// INSERT/REPLACE/UPDATE/DELETE 语句同样经过审计钩子和查询观察者, 其他语句(如 DDL)只通知观察者, op 为 "exec".
+func ExecMulti(statements []string) error {
+	return execMulti(DB, statements)
+}
+
+// 在事务内依次执行多条语句, 规则同 ExecMulti
+// 注意 MySQL 的 DDL 语句会隐式提交事务, 事务只对 DML 语句有效
+func (t *Tx) ExecMulti(statements []string) error {
+	return execMulti(t.runner(), statements)
+}
+
+func execMulti(r sqlRunner, statements []string) error {
+	for i, stmt := range statements {
+		loggerFor(r).DEBUG(stmt)
+		var err error
+		if op := statementOp(stmt); op != "exec" {
+			_, err = execWrite(context.Background(), r, op, stmt, nil)
+		} else {
+			_, err = sqlExec(context.Background(), r, stmt, nil)
+			observe(r, op, stmt, nil, 0, err)
+		}
+		if err != nil {
+			return fmt.Errorf("statement %v (%v) failed: %w", i+1, abbreviate(stmt, 60), err)
+		}
+	}
+	return nil
+}
+
+// 语句的写操作类型, 与审计钩子的 op 一致, 不是写操作时返回 "exec"
+func statementOp(stmt string) string {
+	fields := strings.Fields(stmt)
+	if len(fields) == 0 {
+		return "exec"
+	}
+	switch op := strings.ToLower(fields[0]); op {
+	case "insert", "replace", "update", "delete":
+		return op
+	}
+	return "exec"
+}
+
+// 把以 ; 分隔的脚本拆分为单条语句, 忽略空语句
+// 引号(' " `)内的 ; 不作为分隔符, "-- " 和 # 开头的行注释被去掉, 不支持 DELIMITER 命令
+func SplitStatements(script string) []string {
+	var statements []string
+	var b strings.Builder
+	var quote rune
+	comment := false
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case comment:
+			if r == '\n' {
+				comment = false
+				b.WriteRune(r)
+			}
+		case quote != 0:
+			b.WriteRune(r)
+			if r == '\\' && quote != '`' && i+1 < len(runes) {
+				i++
+				b.WriteRune(runes[i])
+			} else if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+			b.WriteRune(r)
+		case r == '#' || r == '-' && i+2 < len(runes) && runes[i+1] == '-' && unicode.IsSpace(runes[i+2]):
+			comment = true
+		case r == ';':
+			if stmt := strings.TrimSpace(b.String()); stmt != "" {
+				statements = append(statements, stmt)
+			}
+			b.Reset()
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if stmt := strings.TrimSpace(b.String()); stmt != "" {
+		statements = append(statements, stmt)
+	}
+	return statements
+}
+
+// 截断过长的语句, 用于错误信息
+func abbreviate(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "..."
+	}
+	return s
+}
+
+// 执行返回多个结果集的语句(例如存储过程 CALL proc()), 按顺序把每个结果集扫描到对应的 dest
+// dest 可以是:
+//
+//	*T                      取结果集的第一行, 没有行时保持不变
+//	*[]T 或 *[]*T           追加结果集的每一行
+//	*map[string]interface{} 取第一行的列名到值的映射, 文本列为 []byte
+//
+// 结构体按列名扫描, 规则同 GetOne. 需要 mysql 驱动 1.4 及以上版本;
+// 一次执行多条语句(而不是 CALL)时还需要在连接字符串中加 multiStatements=true.
+// 结果集比 dest 多时多出的结果集被忽略, 少时返回错误.
+func QueryMulti(query string, dests ...interface{}) error {
+	if DB == nil {
+		return ErrNotInitialized
+	}
+	logger.DEBUG(query)
+	ctx, cancel := withDefaultTimeout(context.Background(), DB)
+	defer cancel()
+	rows, err := DB.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for i, dest := range dests {
+		if i > 0 && !rows.NextResultSet() {
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("query returned %v result sets, expect %v", i, len(dests))
+		}
+		if err := scanResultSet(rows, dest); err != nil {
+			return fmt.Errorf("result set %v: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// 把当前结果集扫描到 dest, 读完结果集的所有行
+func scanResultSet(rows *sql.Rows, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.New("param type is not Ptr")
+	}
+	v = v.Elem()
+	switch {
+	case v.Type() == reflect.TypeOf(map[string]interface{}{}):
+		columns, err := rows.Columns()
+		if err != nil {
+			return err
+		}
+		if rows.Next() {
+			values := make([]interface{}, len(columns))
+			pointers := make([]interface{}, len(columns))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			if err := rows.Scan(pointers...); err != nil {
+				return err
+			}
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			for i, column := range columns {
+				v.SetMapIndex(reflect.ValueOf(column), reflect.ValueOf(&values[i]).Elem())
+			}
+		}
+	case v.Kind() == reflect.Struct:
+		scanner, err := newRowScanner(rows, v.Type())
+		if err != nil {
+			return err
+		}
+		if rows.Next() {
+			if err := scanner.scan(dest); err != nil {
+				return err
+			}
+		}
+	case v.Kind() == reflect.Slice:
+		elem := v.Type().Elem()
+		isPtr := elem.Kind() == reflect.Ptr
+		if isPtr {
+			elem = elem.Elem()
+		}
+		if elem.Kind() != reflect.Struct {
+			return errors.New("param type is not Slice of Struct")
+		}
+		scanner, err := newRowScanner(rows, elem)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			row := reflect.New(elem)
+			if err := scanner.scan(row.Interface()); err != nil {
+				return err
+			}
+			if !isPtr {
+				row = row.Elem()
+			}
+			v.Set(reflect.Append(v, row))
+		}
+	default:
+		return fmt.Errorf("unsupported dest type %T", dest)
+	}
+	// 读完剩余的行才能切换到下一个结果集
+	for rows.Next() {
+	}
+	return rows.Err()
+}
@@ -0,0 +1,38 @@
+package golibs
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExecMultiAuditsWrites(t *testing.T) {
+	f := useFakeDB(t)
+	var audited, observed []string
+	SetAuditHook(func(op, sql string, args []interface{}) error {
+		audited = append(audited, op)
+		if sql == "DELETE FROM t" {
+			return errors.New("denied")
+		}
+		return nil
+	})
+	defer SetAuditHook(nil)
+	SetQueryObserver(func(op, sql string, args []interface{}, rows int64, err error) {
+		observed = append(observed, op)
+	})
+	defer SetQueryObserver(nil)
+
+	err := ExecMulti(SplitStatements("CREATE TABLE t (id INT); insert into t VALUES (1); UPDATE t SET id = 2; DELETE FROM t"))
+	if err == nil {
+		t.Fatal("expected the audit hook to abort the DELETE")
+	}
+	if want := []string{"insert", "update", "delete"}; !reflect.DeepEqual(audited, want) {
+		t.Errorf("audited %v, want %v", audited, want)
+	}
+	if want := []string{"exec", "insert", "update"}; !reflect.DeepEqual(observed, want) {
+		t.Errorf("observed %v, want %v", observed, want)
+	}
+	if len(f.execs) != 3 {
+		t.Errorf("executed %v statements, want 3", len(f.execs))
+	}
+}
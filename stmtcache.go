@@ -0,0 +1,102 @@
+package golibs
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// 缓存的预处理语句数量上限, 0 表示不缓存
+// 开启后同一条写语句(如相同结构的 INSERT)只预处理一次, 之后直接复用, 超过上限时关闭最久未使用的语句.
+// 每条缓存的语句会在用到的每个连接上各占一个服务端预处理语句, 注意不要超过 max_prepared_stmt_count.
+// 只对直接在连接池上执行的语句生效, 事务内以及设置了 ConnAcquireTimeout 时不缓存.
+var StmtCacheSize = 0
+
+type stmtKey struct {
+	db    *sql.DB
+	query string
+}
+
+type stmtEntry struct {
+	key     stmtKey
+	stmt    *sql.Stmt
+	refs    int  // 正在使用的次数
+	evicted bool // 已移出缓存, 使用完后关闭
+}
+
+// 按 LRU 淘汰的预处理语句缓存
+type stmtCache struct {
+	mu    sync.Mutex
+	ll    *list.List
+	items map[stmtKey]*list.Element
+}
+
+var stmts = &stmtCache{ll: list.New(), items: make(map[stmtKey]*list.Element)}
+
+// 取出 query 对应的预处理语句, 用完后必须调用返回的 release
+func (c *stmtCache) get(ctx context.Context, db *sql.DB, query string) (*sql.Stmt, func(), error) {
+	key := stmtKey{db: db, query: query}
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		e := el.Value.(*stmtEntry)
+		e.refs++
+		c.mu.Unlock()
+		return e.stmt, func() { c.release(e) }, nil
+	}
+	c.mu.Unlock()
+
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		// 其他 goroutine 已经放入了同一条语句
+		stmt.Close()
+		e := el.Value.(*stmtEntry)
+		e.refs++
+		return e.stmt, func() { c.release(e) }, nil
+	}
+	e := &stmtEntry{key: key, stmt: stmt, refs: 1}
+	c.items[key] = c.ll.PushFront(e)
+	for c.ll.Len() > StmtCacheSize {
+		c.remove(c.ll.Back())
+	}
+	return stmt, func() { c.release(e) }, nil
+}
+
+func (c *stmtCache) release(e *stmtEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.refs--
+	if e.evicted && e.refs == 0 {
+		e.stmt.Close()
+	}
+}
+
+// 移出缓存, 没有在使用时立即关闭, 调用方需持有锁
+func (c *stmtCache) remove(el *list.Element) {
+	e := el.Value.(*stmtEntry)
+	c.ll.Remove(el)
+	delete(c.items, e.key)
+	e.evicted = true
+	if e.refs == 0 {
+		e.stmt.Close()
+	}
+}
+
+// 关闭并移除 db 的所有缓存语句, 关闭连接池时调用
+func (c *stmtCache) clear(db *sql.DB) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*stmtEntry).key.db == db {
+			c.remove(el)
+		}
+		el = next
+	}
+}
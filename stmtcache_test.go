@@ -0,0 +1,111 @@
+package golibs
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"testing"
+)
+
+// 使用独立的缓存, 不影响全局的 stmts
+func newTestStmtCache(t *testing.T, size int) *stmtCache {
+	old := StmtCacheSize
+	StmtCacheSize = size
+	t.Cleanup(func() { StmtCacheSize = old })
+	return &stmtCache{ll: list.New(), items: make(map[stmtKey]*list.Element)}
+}
+
+func (c *stmtCache) cachedQueries() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var queries []string
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		queries = append(queries, el.Value.(*stmtEntry).key.query)
+	}
+	return queries
+}
+
+func TestStmtCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	db, f := newFakeDB(t)
+	c := newTestStmtCache(t, 2)
+	ctx := context.Background()
+	for _, query := range []string{"a", "b", "a", "c"} {
+		_, done, err := c.get(ctx, db, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done()
+	}
+	if got := c.cachedQueries(); len(got) != 2 || got[0] != "c" || got[1] != "a" {
+		t.Fatalf("cached %v, want [c a]", got)
+	}
+	if n := atomic.LoadInt64(&f.prepares); n != 3 {
+		t.Errorf("prepared %v times, want 3", n)
+	}
+	if n := atomic.LoadInt64(&f.closes); n != 1 {
+		t.Errorf("closed %v statements, want 1 (b)", n)
+	}
+}
+
+func TestStmtCacheKeepsEvictedStatementUntilReleased(t *testing.T) {
+	db, _ := newFakeDB(t)
+	c := newTestStmtCache(t, 1)
+	ctx := context.Background()
+	held, release, err := c.get(ctx, db, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, done, err := c.get(ctx, db, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	// a 已被淘汰, 但仍在使用中, 不能被关闭
+	if _, err := held.ExecContext(ctx); err != nil {
+		t.Fatalf("evicted statement closed while in use: %v", err)
+	}
+	release()
+	if _, err := held.ExecContext(ctx); err == nil {
+		t.Fatal("evicted statement still open after release")
+	}
+}
+
+func TestStmtCacheClear(t *testing.T) {
+	db, _ := newFakeDB(t)
+	other, _ := newFakeDB(t)
+	c := newTestStmtCache(t, 4)
+	ctx := context.Background()
+	for _, r := range []*sql.DB{db, other} {
+		_, done, err := c.get(ctx, r, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done()
+	}
+	c.clear(db)
+	if got := c.cachedQueries(); len(got) != 1 {
+		t.Fatalf("cached %v after clear, want only the other db's statement", got)
+	}
+}
+
+func benchmarkInsert(b *testing.B, cacheSize int) {
+	f := useFakeDB(b)
+	old, oldLevel := StmtCacheSize, LogLevel
+	StmtCacheSize, LogLevel = cacheSize, LevelInfo
+	defer func() { StmtCacheSize, LogLevel = old, oldLevel }()
+	defer stmts.clear(DB)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := InsertE(&testUser{Name: "a", Age: i}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&f.prepares))/float64(b.N), "prepares/op")
+}
+
+func BenchmarkInsertStmtCache(b *testing.B) {
+	b.Run("off", func(b *testing.B) { benchmarkInsert(b, 0) })
+	b.Run("on", func(b *testing.B) { benchmarkInsert(b, 16) })
+}
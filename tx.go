@@ -0,0 +1,220 @@
+package golibs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// 数据库事务
+type Tx struct {
+	tx *sql.Tx
+	db *Database // Database.Begin 开启时为所属的连接, 全局 Begin 开启时为 nil
+}
+
+// Database.Begin 开启的事务, 带上所属的连接以使用其日志和超时设置
+type dbTx struct {
+	*sql.Tx
+	db *Database
+}
+
+// 在事务内执行语句使用的 sqlRunner
+func (t *Tx) runner() sqlRunner {
+	if t.db == nil {
+		return t.tx
+	}
+	return dbTx{Tx: t.tx, db: t.db}
+}
+
+// 开启一个事务
+func Begin() (*Tx, error) {
+	if DB == nil {
+		return nil, ErrNotInitialized
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx: tx}, nil
+}
+
+// 提交事务
+func (t *Tx) Commit() error {
+	return t.tx.Commit()
+}
+
+// 回滚事务
+func (t *Tx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// 在一个事务内执行 fn, fn 返回 error 或 panic 时回滚, 否则提交
+// panic 在回滚之后继续向上抛出. 返回 fn 的错误或提交的错误
+func Transaction(fn func(tx *Tx) error) error {
+	tx, err := Begin()
+	if err != nil {
+		return err
+	}
+	return tx.run(fn)
+}
+
+func (t *Tx) run(fn func(tx *Tx) error) error {
+	defer func() {
+		if p := recover(); p != nil {
+			t.Rollback()
+			panic(p)
+		}
+	}()
+	if err := fn(t); err != nil {
+		t.Rollback()
+		return err
+	}
+	return t.Commit()
+}
+
+// 在事务内插入一条记录, 返回记录的id
+func (t *Tx) Insert(st interface{}) (int64, error) {
+	return insert(context.Background(), t.runner(), st)
+}
+
+// 在事务内根据id更新一条记录, 返回影响的条数
+func (t *Tx) Update(st interface{}) (int64, error) {
+	return update(context.Background(), t.runner(), st)
+}
+
+// 在事务内根据id只更新列出的列, 规则同 UpdateFields
+func (t *Tx) UpdateFields(st interface{}, fields ...string) (int64, error) {
+	return update(context.Background(), t.runner(), st, fields...)
+}
+
+// 在事务内一条语句插入多条记录, 规则同 InsertBatch
+func (t *Tx) InsertBatch(sts interface{}) (int64, error) {
+	return insertBatch(t.runner(), sts, false)
+}
+
+// 在事务内保存一条记录, 规则同 Save
+func (t *Tx) Save(st interface{}) (int64, error) {
+	return save(context.Background(), t.runner(), st)
+}
+
+// 在事务内根据id删除一条记录, 返回删除的条数
+func (t *Tx) Delete(st interface{}) (int64, error) {
+	return del(context.Background(), t.runner(), st)
+}
+
+// 绑定到当前事务的查询构造器
+// GetOne/GetMany/Each 都在事务内执行, 可以读到本事务尚未提交的写入
+func (t *Tx) GetQueryBuilder() *QueryBuilder {
+	q := GetQueryBuilder()
+	q.runner = t.runner()
+	return q
+}
+
+// 根据id更新一条记录, 并把更新后的整行重新读回 st (需传入指针)
+// 用于获取触发器或列默认值等在数据库端产生的最新状态.
+// MySQL 不支持 UPDATE ... RETURNING, 这里在一个事务内先 UPDATE 再按主键 SELECT,
+// 比 Update 多一次往返. 返回影响的条数.
+func UpdateReturning(st interface{}) (int64, error) {
+	if reflect.TypeOf(st).Kind() != reflect.Ptr {
+		return 0, errors.New("param type is not Ptr")
+	}
+	id, err := PrimaryKeyValue(st)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := Begin()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Update(st)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if _, err := tx.GetQueryBuilder().Select(st).Where(PrimaryKey, id).GetOne(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return rows, tx.Commit()
+}
+
+// ImportJSONL 每批插入的记录数, 不大于 0 时使用默认的 500
+var ImportChunkSize = 500
+
+const defaultImportChunkSize = 500
+
+// 从每行一个 JSON 对象的数据中导入记录, model 为模型结构体或其指针
+// 每行按结构体的 json 标签解码为一个新的模型实例(只能填充导出的字段), 空行跳过,
+// 每 ImportChunkSize 条用 InsertBatch 插入一次. 所有批次在同一个事务内执行,
+// 任何一行解码或插入失败都会回滚整个导入. 返回插入的总条数.
+func ImportJSONL(model interface{}, r io.Reader) (int64, error) {
+	t := reflect.TypeOf(model)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return 0, errors.New("param type is not Struct")
+	}
+	tx, err := Begin()
+	if err != nil {
+		return 0, err
+	}
+	size := ImportChunkSize
+	if size <= 0 {
+		size = defaultImportChunkSize
+	}
+	var total int64
+	chunk := reflect.MakeSlice(reflect.SliceOf(reflect.PtrTo(t)), 0, size)
+	flush := func() error {
+		if chunk.Len() == 0 {
+			return nil
+		}
+		n, err := tx.InsertBatch(chunk.Interface())
+		if err != nil {
+			return err
+		}
+		total += n
+		chunk = chunk.Slice(0, 0)
+		return nil
+	}
+
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			tx.Rollback()
+			return 0, readErr
+		}
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			obj := reflect.New(t)
+			if err := json.Unmarshal(data, obj.Interface()); err != nil {
+				tx.Rollback()
+				return 0, fmt.Errorf("line %v: %w", line, err)
+			}
+			chunk = reflect.Append(chunk, obj)
+			if chunk.Len() >= size {
+				if err := flush(); err != nil {
+					tx.Rollback()
+					return 0, err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if err := flush(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
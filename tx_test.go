@@ -0,0 +1,35 @@
+package golibs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTransactionReturnsCommitError(t *testing.T) {
+	f := useFakeDB(t)
+	f.commit = errFake
+	err := Transaction(func(tx *Tx) error {
+		_, err := tx.Insert(&testUser{Name: "a"})
+		return err
+	})
+	if !errors.Is(err, errFake) {
+		t.Fatalf("Transaction error = %v, want the commit error", err)
+	}
+}
+
+func TestImportJSONLFallsBackToDefaultChunkSize(t *testing.T) {
+	f := useFakeDB(t)
+	old := ImportChunkSize
+	defer func() { ImportChunkSize = old }()
+	for _, size := range []int{0, -1} {
+		ImportChunkSize = size
+		n, err := ImportJSONL(&testUser{}, strings.NewReader("{\"Name\":\"a\"}\n{\"Name\":\"b\"}\n"))
+		if err != nil || n != 1 {
+			t.Fatalf("ImportChunkSize %v: ImportJSONL = %v, %v", size, n, err)
+		}
+		if args := f.lastExec().args; len(args) != 4 {
+			t.Fatalf("ImportChunkSize %v: one batch bound %v values, want 4", size, len(args))
+		}
+	}
+}
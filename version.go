@@ -0,0 +1,55 @@
+package golibs
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// 最近一次 ServerInfo 读到的服务器版本
+var serverVersion atomic.Value
+
+// 查询已连接的 MySQL 服务器版本, 例如 "8.0.36" 或 "10.6.16-MariaDB"
+// 同时也用于检查连接是否可用. 结果会被缓存, 之后依赖特定版本的功能
+// (如 MAX_EXECUTION_TIME 提示) 在服务器不支持时自动关闭; 未调用时假定都支持.
+func ServerInfo(ctx context.Context) (version string, err error) {
+	if DB == nil {
+		return "", ErrNotInitialized
+	}
+	if err := DB.QueryRowContext(ctx, "SELECT VERSION()").Scan(&version); err != nil {
+		return "", err
+	}
+	serverVersion.Store(version)
+	return version, nil
+}
+
+// 服务器版本是否不低于 major.minor.patch, 版本未知时返回 true
+// MariaDB 的版本号与 MySQL 不可比较, 总是返回 false
+func serverAtLeast(major, minor, patch int) bool {
+	version, _ := serverVersion.Load().(string)
+	if version == "" {
+		return true
+	}
+	if strings.Contains(version, "MariaDB") {
+		return false
+	}
+	if i := strings.IndexAny(version, "-+ "); i >= 0 {
+		version = version[:i]
+	}
+	want := []int{major, minor, patch}
+	parts := strings.Split(version, ".")
+	for i, w := range want {
+		if i >= len(parts) {
+			return w == 0
+		}
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return true
+		}
+		if n != w {
+			return n > w
+		}
+	}
+	return true
+}